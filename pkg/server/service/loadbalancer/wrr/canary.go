@@ -0,0 +1,317 @@
+package wrr
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/traefik/traefik/v2/pkg/log"
+)
+
+// CanaryStep describes one step of a canary ramp schedule: once Interval has
+// elapsed since the previous step, the canary's traffic share is raised to
+// Fraction. The first step applies as soon as the canary is added; its
+// Interval is not used.
+type CanaryStep struct {
+	// Fraction is the share of traffic (0 to 1) the canary should receive
+	// once this step is reached.
+	Fraction float64
+	// Interval is how long to wait, after the previous step, before moving
+	// to this step.
+	Interval time.Duration
+}
+
+// CanaryConfig configures the progressive rollout and health tracking of a
+// single canary handler, modeled after Nomad's progress-deadline/auto-revert
+// deployment semantics.
+type CanaryConfig struct {
+	// Steps is the ramp schedule, in order. The canary starts at Steps[0]
+	// immediately and advances through the remaining steps over time.
+	Steps []CanaryStep
+	// ProgressDeadline is how long the canary is allowed to run, counted
+	// from the moment it is added, before it is considered to have proven
+	// itself. Failures observed after the deadline no longer trigger an
+	// auto-revert.
+	ProgressDeadline time.Duration
+	// MaxConsecutiveFailures is the number of consecutive 5xx responses
+	// that triggers an auto-revert.
+	MaxConsecutiveFailures uint64
+	// MaxErrorRate is the 5xx ratio (0 to 1), computed over all requests
+	// observed so far, that triggers an auto-revert.
+	MaxErrorRate float64
+}
+
+// canaryStats holds the health statistics the balancer tracks for a single
+// canary, accumulated over every request it has served.
+type canaryStats struct {
+	mu                  sync.Mutex
+	requests            uint64
+	errors              uint64
+	consecutiveFailures uint64
+	latencyP99          time.Duration
+}
+
+// observe records the outcome of one request served by the canary and
+// returns the updated consecutive-failure count and error ratio.
+func (s *canaryStats) observe(statusCode int, latency time.Duration) (consecutiveFailures uint64, errorRate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if statusCode >= http.StatusInternalServerError {
+		s.errors++
+		s.consecutiveFailures++
+	} else {
+		s.consecutiveFailures = 0
+	}
+
+	// Cheap running estimate of the tail latency: nudge towards the
+	// observed sample, weighted so that outliers dominate faster than a
+	// plain EWMA would.
+	if latency > s.latencyP99 {
+		s.latencyP99 = latency
+	} else {
+		s.latencyP99 -= (s.latencyP99 - latency) / 10
+	}
+
+	return s.consecutiveFailures, float64(s.errors) / float64(s.requests)
+}
+
+// canaryState is the balancer-side bookkeeping for one registered canary.
+type canaryState struct {
+	name      string
+	nh        *namedHandler
+	cfg       CanaryConfig
+	startedAt time.Time
+
+	mu       sync.Mutex
+	fraction float64
+	stepIdx  int
+	reverted bool
+
+	stats canaryStats
+
+	stop chan struct{}
+}
+
+// AddCanary registers handler as a canary named name, carrying weight as its
+// full-traffic weight once promoted. Traffic is ramped towards it according
+// to canaryCfg, and the balancer auto-reverts the canary if it breaches its
+// failure thresholds before canaryCfg.ProgressDeadline has elapsed.
+func (b *Balancer) AddCanary(name string, handler http.Handler, weight *int, canaryCfg CanaryConfig) {
+	w := 1
+	if weight != nil {
+		w = *weight
+	}
+	if w <= 0 || len(canaryCfg.Steps) == 0 {
+		return
+	}
+
+	nh := &namedHandler{
+		Handler:         handler,
+		name:            name,
+		weight:          float64(w),
+		healthy:         true,
+		externalHealthy: true,
+		isCanary:        true,
+	}
+
+	cs := &canaryState{
+		name:      name,
+		nh:        nh,
+		cfg:       canaryCfg,
+		startedAt: time.Now(),
+		fraction:  canaryCfg.Steps[0].Fraction,
+		stop:      make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	if b.canaries == nil {
+		b.canaries = make(map[string]*canaryState)
+	}
+	b.canaries[name] = cs
+	b.handlersByName[name] = nh
+	b.mutex.Unlock()
+
+	if len(canaryCfg.Steps) > 1 {
+		go b.rampCanary(cs)
+	}
+}
+
+// rampCanary advances cs through its remaining steps, one per tick of that
+// step's Interval, until it reaches the last step or is reverted/promoted.
+func (b *Balancer) rampCanary(cs *canaryState) {
+	for _, step := range cs.cfg.Steps[1:] {
+		timer := time.NewTimer(step.Interval)
+		select {
+		case <-timer.C:
+		case <-cs.stop:
+			timer.Stop()
+			return
+		}
+
+		cs.mu.Lock()
+		if cs.reverted {
+			cs.mu.Unlock()
+			return
+		}
+		cs.stepIdx++
+		cs.fraction = step.Fraction
+		cs.mu.Unlock()
+	}
+}
+
+// canaryFraction returns the traffic fraction currently assigned to name, or
+// 0 if name is not a registered, un-reverted canary.
+func (b *Balancer) canaryFraction(name string) float64 {
+	b.mutex.RLock()
+	cs := b.canaries[name]
+	b.mutex.RUnlock()
+	if cs == nil {
+		return 0
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.reverted {
+		return 0
+	}
+	return cs.fraction
+}
+
+// recordCanaryResult feeds the outcome of a request served by the canary
+// into its health statistics, and auto-reverts it if it has crossed its
+// failure threshold while still within its progress deadline.
+func (b *Balancer) recordCanaryResult(ctx context.Context, cs *canaryState, statusCode int, latency time.Duration) {
+	consecutiveFailures, errorRate := cs.stats.observe(statusCode, latency)
+
+	cs.mu.Lock()
+	withinDeadline := cs.cfg.ProgressDeadline <= 0 || time.Since(cs.startedAt) < cs.cfg.ProgressDeadline
+	alreadyReverted := cs.reverted
+	cs.mu.Unlock()
+
+	if alreadyReverted || !withinDeadline {
+		return
+	}
+
+	breached := (cs.cfg.MaxConsecutiveFailures > 0 && consecutiveFailures >= cs.cfg.MaxConsecutiveFailures) ||
+		(cs.cfg.MaxErrorRate > 0 && errorRate >= cs.cfg.MaxErrorRate)
+	if !breached {
+		return
+	}
+
+	reason := "consecutive failures"
+	if cs.cfg.MaxErrorRate > 0 && errorRate >= cs.cfg.MaxErrorRate {
+		reason = "error rate"
+	}
+	b.revertCanary(ctx, cs, reason)
+}
+
+// revertCanary removes cs from traffic selection and notifies any
+// registered canary updaters with the failure reason.
+func (b *Balancer) revertCanary(ctx context.Context, cs *canaryState, reason string) {
+	cs.mu.Lock()
+	if cs.reverted {
+		cs.mu.Unlock()
+		return
+	}
+	cs.reverted = true
+	cs.mu.Unlock()
+
+	close(cs.stop)
+
+	b.mutex.Lock()
+	delete(b.canaries, cs.name)
+	delete(b.handlersByName, cs.name)
+	b.mutex.Unlock()
+
+	log.FromContext(ctx).Warnf("Auto-reverting canary %s: %s", cs.name, reason)
+	for _, fn := range b.canaryUpdaters {
+		fn(cs.name, reason)
+	}
+}
+
+// PromoteCanary collapses the canary named name into a normal handler in
+// enabledHandlers carrying its full configured weight (ramped up under slow
+// start like a newly added handler), stopping its canary ramp and removing
+// it from canary bookkeeping.
+func (b *Balancer) PromoteCanary(name string) {
+	b.mutex.Lock()
+	cs := b.canaries[name]
+	if cs == nil {
+		b.mutex.Unlock()
+		return
+	}
+	delete(b.canaries, name)
+	b.mutex.Unlock()
+
+	cs.mu.Lock()
+	if cs.reverted {
+		cs.mu.Unlock()
+		return
+	}
+	cs.reverted = true
+	cs.mu.Unlock()
+	close(cs.stop)
+
+	nh := cs.nh
+	b.mutex.Lock()
+	// Promote it the same way Add would: idle base pending rather than 0
+	// (which would make it the heap minimum and flood it immediately),
+	// and a fresh slow-start ramp rather than full weight right away. It
+	// also stops being a canary, so it's now eligible for the alias table
+	// and the preferred/sticky-name fast path like any other handler.
+	nh.isCanary = false
+	nh.pending = 1
+	nh.slowStart = b.slowStart
+	nh.readyAt = time.Now()
+	b.enabledHandlers.push(nh)
+	b.healthyCount++
+	b.rebuildAliasTable()
+	b.mutex.Unlock()
+}
+
+// RegisterCanaryUpdater adds fn to the list of hooks run whenever a canary
+// is auto-reverted, passing its name and the reason for the revert.
+func (b *Balancer) RegisterCanaryUpdater(fn func(name, reason string)) {
+	b.canaryUpdaters = append(b.canaryUpdaters, fn)
+}
+
+// pickCanary rolls the dice for the request against the combined fraction of
+// all registered, un-reverted canaries, and returns the one selected, or nil
+// if the request should go through the normal WRR selection instead.
+func (b *Balancer) pickCanary() *canaryState {
+	b.mutex.RLock()
+	if len(b.canaries) == 0 {
+		b.mutex.RUnlock()
+		return nil
+	}
+	candidates := make([]*canaryState, 0, len(b.canaries))
+	for _, cs := range b.canaries {
+		candidates = append(candidates, cs)
+	}
+	b.mutex.RUnlock()
+
+	r := rand.Float64()
+	var cumulative float64
+	for _, cs := range candidates {
+		cumulative += b.canaryFraction(cs.name)
+		if r < cumulative {
+			return cs
+		}
+	}
+	return nil
+}
+
+// serveCanary dispatches req to the canary's handler, stamps the X-Canary
+// response header for downstream observability, and feeds the outcome back
+// into the canary's health statistics.
+func (b *Balancer) serveCanary(w http.ResponseWriter, req *http.Request, cs *canaryState) {
+	w.Header().Set("X-Canary", cs.name)
+
+	rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	start := time.Now()
+	cs.nh.ServeHTTP(rec, req)
+	b.recordCanaryResult(req.Context(), cs, rec.statusCode, time.Since(start))
+}
@@ -0,0 +1,105 @@
+package wrr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanaryPromote(t *testing.T) {
+	ss := time.Hour
+	b := New(nil, false, WithSlowStart(ss))
+	addDummyHandler(b, "stable", 1)
+	b.AddCanary("canary", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), intPtr(1), CanaryConfig{
+		Steps: []CanaryStep{{Fraction: 1}},
+	})
+
+	require.Contains(t, b.canaries, "canary")
+
+	b.PromoteCanary("canary")
+	assert.NotContains(t, b.canaries, "canary")
+	nh, ok := b.handlersByName["canary"]
+	require.True(t, ok)
+
+	// It should join the heap at the idle base, not 0 (which would make
+	// it the heap minimum and flood it), and ramp up like any other
+	// newly added handler instead of serving at full weight immediately.
+	assert.EqualValues(t, 1, nh.pending)
+	assert.True(t, nh.warming(time.Now()))
+}
+
+func TestCanaryAutoRevertOnConsecutiveFailures(t *testing.T) {
+	b := New(nil, false)
+	addDummyHandler(b, "stable", 1)
+
+	var reverts []string
+	b.RegisterCanaryUpdater(func(name, reason string) {
+		reverts = append(reverts, name+":"+reason)
+	})
+
+	b.AddCanary("canary", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "boom", http.StatusInternalServerError)
+	}), intPtr(1), CanaryConfig{
+		Steps:                  []CanaryStep{{Fraction: 1}},
+		ProgressDeadline:       time.Minute,
+		MaxConsecutiveFailures: 2,
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		cs := b.canaries["canary"]
+		require.NotNil(t, cs)
+		b.serveCanary(rec, req, cs)
+	}
+
+	assert.NotContains(t, b.canaries, "canary")
+	assert.Equal(t, []string{"canary:consecutive failures"}, reverts)
+}
+
+func TestCanaryExcludedFromAliasTable(t *testing.T) {
+	b := New(nil, false, WithSelectionStrategy(StrategyP2CEWMA))
+	addDummyHandler(b, "stable", 1)
+	b.AddCanary("canary", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), intPtr(1), CanaryConfig{
+		Steps: []CanaryStep{{Fraction: 1}},
+	})
+
+	// The canary is only ever supposed to receive traffic through its own
+	// ramped fraction; it must not also double-dip into normal WRR/P2C
+	// selection via the alias table.
+	for i := 0; i < 50; i++ {
+		nh, err := b.acquireHandler(handlerAny, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "stable", nh.name)
+		b.releaseHandler(nh, 1)
+	}
+}
+
+func TestCanaryNotReachableAsPreferredName(t *testing.T) {
+	b := New(nil, false)
+	addDummyHandler(b, "stable", 1)
+	b.AddCanary("canary", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), intPtr(1), CanaryConfig{
+		Steps: []CanaryStep{{Fraction: 1}},
+	})
+
+	// Naming the canary as a preferred/sticky target must not reach it:
+	// it was never pushed onto the heap, so fixing it up here would
+	// corrupt the real handlers' priority queue.
+	nh, err := b.acquireHandler("canary", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "stable", nh.name)
+}
+
+func intPtr(v int) *int {
+	return &v
+}
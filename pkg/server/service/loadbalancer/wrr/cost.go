@@ -0,0 +1,99 @@
+package wrr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+const (
+	// defaultBigRequestThreshold is the request Content-Length above which
+	// a request is classified as "big" by
+	// NewContentLengthCostEstimator.
+	defaultBigRequestThreshold = 4 * 1024 * 1024 // 4 MiB
+
+	// bigRequestCostFactor is how many times more expensive a "big"
+	// request is considered relative to a normal one.
+	bigRequestCostFactor = 16
+)
+
+// CostEstimator estimates, ahead of time, the cost of handling req, in
+// arbitrary units comparable across requests (a request twice as expensive
+// should return twice the cost of a baseline request, which is 1).
+type CostEstimator func(req *http.Request) uint64
+
+// NewContentLengthCostEstimator returns a CostEstimator that classifies
+// requests whose Content-Length exceeds bigRequestThreshold bytes as
+// bigRequestCostFactor times more expensive than a normal request,
+// following the same bucketing approach TiKV's resource-group controller
+// uses for RRU accounting. A bigRequestThreshold of 0 or less uses
+// defaultBigRequestThreshold.
+func NewContentLengthCostEstimator(bigRequestThreshold int64) CostEstimator {
+	threshold := int64(defaultBigRequestThreshold)
+	if bigRequestThreshold > 0 {
+		threshold = bigRequestThreshold
+	}
+	return func(req *http.Request) uint64 {
+		return bucketCost(req.ContentLength, threshold)
+	}
+}
+
+// bucketCost buckets size into either the normal or the big-request cost,
+// relative to threshold. A negative size (unknown length) is treated as
+// normal cost.
+func bucketCost(size, threshold int64) uint64 {
+	if size > threshold {
+		return bigRequestCostFactor
+	}
+	return 1
+}
+
+// responseRecorder wraps a http.ResponseWriter to observe the status code
+// written to it, so the balancer can feed it into outlier detection and
+// canary health tracking once the response is known.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush forwards to the wrapped ResponseWriter's Flush, if it supports
+// streaming, so handlers serving e.g. SSE don't silently stop flushing just
+// because the balancer sits in front of them.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack forwards to the wrapped ResponseWriter's Hijack, if it supports
+// hijacking, so handlers serving e.g. WebSocket upgrades keep working
+// through the balancer.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// ReadFrom forwards to the wrapped ResponseWriter's ReadFrom, if available,
+// falling back to a plain copy through Write otherwise.
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{r}, src)
+}
+
+// writerOnly strips any methods other than Write from r, so io.Copy can't
+// shortcut back into r.ReadFrom and recurse.
+type writerOnly struct {
+	io.Writer
+}
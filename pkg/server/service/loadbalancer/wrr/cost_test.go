@@ -0,0 +1,95 @@
+package wrr
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalancerCostAware(t *testing.T) {
+	b := New(nil, false)
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+
+	// A cheap request picks the least loaded backend by count, as before.
+	nhA, err := b.acquireHandler(handlerAny, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "A", nhA.name)
+
+	// A big, expensive request should weigh in much more heavily than a
+	// handful of cheap ones, so the next pick should avoid it.
+	nhB, err := b.acquireHandler(handlerAny, bigRequestCostFactor)
+	require.NoError(t, err)
+	assert.Equal(t, "B", nhB.name)
+
+	for i := 0; i < int(bigRequestCostFactor)-1; i++ {
+		nh, err := b.acquireHandler(handlerAny, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "A", nh.name)
+	}
+}
+
+func TestContentLengthCostEstimator(t *testing.T) {
+	estimate := NewContentLengthCostEstimator(1024)
+
+	small := httptest.NewRequest(http.MethodPost, "/", nil)
+	small.ContentLength = 512
+	assert.EqualValues(t, 1, estimate(small))
+
+	big := httptest.NewRequest(http.MethodPost, "/", nil)
+	big.ContentLength = 4096
+	assert.EqualValues(t, bigRequestCostFactor, estimate(big))
+}
+
+func TestBalancerReleaseReturnsToBaseline(t *testing.T) {
+	b := New(nil, false)
+	addDummyHandler(b, "A", 1)
+
+	nh, err := b.acquireHandler(handlerAny, 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, nh.pending) // base 1 from Add + acquired 1
+
+	// Release must hand back exactly what was acquired, so pending lands
+	// back on the base 1 rather than drifting.
+	b.Release(nh, 1)
+	assert.EqualValues(t, 1, nh.pending)
+}
+
+// hijackableRecorder is an httptest.ResponseRecorder that also implements
+// http.Hijacker, to exercise responseRecorder's delegation.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	client, _ := net.Pipe()
+	return client, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)), nil
+}
+
+func TestResponseRecorderForwardsFlushAndHijack(t *testing.T) {
+	base := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rec := &responseRecorder{ResponseWriter: base, statusCode: http.StatusOK}
+
+	rec.Flush()
+	assert.True(t, base.Flushed)
+
+	conn, _, err := rec.Hijack()
+	require.NoError(t, err)
+	require.NotNil(t, conn)
+	assert.True(t, base.hijacked)
+	conn.Close()
+}
+
+func TestResponseRecorderHijackUnsupported(t *testing.T) {
+	rec := &responseRecorder{ResponseWriter: httptest.NewRecorder(), statusCode: http.StatusOK}
+
+	_, _, err := rec.Hijack()
+	assert.Error(t, err)
+}
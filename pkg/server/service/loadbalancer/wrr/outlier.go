@@ -0,0 +1,218 @@
+package wrr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// OutlierDetectionConfig configures passive outlier ejection: handlers are
+// removed from rotation based on their own observed error rate, without
+// needing an external health-check system. A zero value disables it.
+type OutlierDetectionConfig struct {
+	// Consecutive5xx is the number of consecutive 5xx responses that
+	// ejects a handler. 0 disables this trigger.
+	Consecutive5xx uint64
+	// ErrorRatio is the 5xx ratio (0 to 1), computed over the requests
+	// seen in the last Interval, that ejects a handler. 0 disables this
+	// trigger.
+	ErrorRatio float64
+	// Interval is the length of the rolling window ErrorRatio is computed
+	// over.
+	Interval time.Duration
+	// BaseEjectionTime is how long a handler is ejected for the first
+	// time it trips a threshold. Each subsequent ejection doubles the
+	// previous duration, up to a hard cap.
+	BaseEjectionTime time.Duration
+	// MaxEjectionPercent is the maximum percentage of handlers that may be
+	// ejected at once; further ejections are skipped until one recovers.
+	// 0 (or any value >= 100) means no cap.
+	MaxEjectionPercent int
+}
+
+func (cfg OutlierDetectionConfig) enabled() bool {
+	return cfg.Consecutive5xx > 0 || cfg.ErrorRatio > 0
+}
+
+// minRatioSamples is how many samples must have landed in the window
+// before ErrorRatio is evaluated, so that a single failed request in an
+// otherwise empty window doesn't look like a 100% error rate.
+const minRatioSamples = 10
+
+// maxOutlierEjection caps how long a single ejection can last, regardless
+// of how many times BaseEjectionTime has doubled.
+const maxOutlierEjection = 10 * time.Minute
+
+// OutlierMetricsHooks are optional callbacks reporting outlier-detection
+// activity, e.g. for wiring up metrics.
+type OutlierMetricsHooks struct {
+	// Ejected is called when a handler is ejected, with the reason that
+	// tripped ejection ("consecutive 5xx" or "error ratio").
+	Ejected func(name, reason string)
+	// Unejected is called when a handler's outlier ejection timer expires,
+	// lifting the outlier-induced down. The handler may still not be
+	// serving traffic afterwards if an external health check
+	// independently took it down in the meantime.
+	Unejected func(name string)
+	// SkippedMaxEjection is called when a handler tripped a threshold but
+	// ejecting it would have exceeded MaxEjectionPercent.
+	SkippedMaxEjection func(name, reason string)
+}
+
+// outlierWindow tracks, per handler, the rolling error samples and
+// consecutive-5xx count used to decide whether to eject it.
+type outlierWindow struct {
+	mu             sync.Mutex
+	samples        []time.Time // timestamps of 5xx responses within cfg.Interval
+	totalAt        []time.Time // timestamps of all requests within cfg.Interval
+	consecutive5xx uint64
+}
+
+// observe records the outcome of one request and reports whether it just
+// tripped a threshold, and why.
+func (w *outlierWindow) observe(cfg OutlierDetectionConfig, now time.Time, statusCode int) (breach bool, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	isError := statusCode >= 500
+	if isError {
+		w.consecutive5xx++
+		w.samples = append(w.samples, now)
+	} else {
+		w.consecutive5xx = 0
+	}
+	w.totalAt = append(w.totalAt, now)
+
+	if cfg.Interval > 0 {
+		cutoff := now.Add(-cfg.Interval)
+		w.samples = pruneBefore(w.samples, cutoff)
+		w.totalAt = pruneBefore(w.totalAt, cutoff)
+	}
+
+	if cfg.Consecutive5xx > 0 && w.consecutive5xx >= cfg.Consecutive5xx {
+		return true, "consecutive 5xx"
+	}
+	if cfg.ErrorRatio > 0 && len(w.totalAt) >= minRatioSamples {
+		if float64(len(w.samples))/float64(len(w.totalAt)) >= cfg.ErrorRatio {
+			return true, "error ratio"
+		}
+	}
+	return false, ""
+}
+
+func pruneBefore(ts []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
+
+// reset clears the window, so a handler returning from ejection starts with
+// a clean slate instead of immediately re-tripping consecutive5xx with a
+// stale count left over from before it was ejected.
+func (w *outlierWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples = nil
+	w.totalAt = nil
+	w.consecutive5xx = 0
+}
+
+// recordOutlierResult feeds the outcome of a request into the handler's
+// outlier window, and ejects it if the window just tripped a threshold.
+func (b *Balancer) recordOutlierResult(nh *namedHandler, statusCode int) {
+	if !b.outlierCfg.enabled() {
+		return
+	}
+
+	b.mutex.Lock()
+	w, ok := b.outlierWindows[nh.name]
+	if !ok {
+		w = &outlierWindow{}
+		b.outlierWindows[nh.name] = w
+	}
+	b.mutex.Unlock()
+
+	if breach, reason := w.observe(b.outlierCfg, time.Now(), statusCode); breach {
+		b.ejectOutlier(nh.name, reason)
+	}
+}
+
+// ejectOutlier ejects name, respecting MaxEjectionPercent, and schedules its
+// automatic recovery after an exponentially-growing ejection time. Ejection
+// is tracked independently of SetStatus's externally-reported health, so an
+// outlier-induced down doesn't get mistaken for (or overwritten by) an
+// external health check's own down, and vice versa; a handler is only
+// eligible to serve traffic again once both agree it's healthy.
+func (b *Balancer) ejectOutlier(name, reason string) {
+	b.mutex.Lock()
+	if b.outlierActive[name] {
+		b.mutex.Unlock()
+		return
+	}
+
+	maxPercent := b.outlierCfg.MaxEjectionPercent
+	capped := maxPercent > 0 && maxPercent < 100
+	// The cap is a percentage of currently healthy handlers, not of the
+	// whole pool: handlers already down (via an external health check or
+	// a prior ejection) shouldn't make room for ejecting the rest of the
+	// healthy ones.
+	total := b.healthyCount
+	if capped && total > 0 && (len(b.outlierActive)+1)*100 > maxPercent*total {
+		b.mutex.Unlock()
+		if b.OutlierMetrics.SkippedMaxEjection != nil {
+			b.OutlierMetrics.SkippedMaxEjection(name, reason)
+		}
+		return
+	}
+
+	b.outlierEjections[name]++
+	ejections := b.outlierEjections[name]
+	b.outlierActive[name] = true
+	nh := b.handlersByName[name]
+	w := b.outlierWindows[name]
+	var before, after bool
+	if nh != nil {
+		before, after = b.transitionHealthy(nh, false)
+	}
+	b.mutex.Unlock()
+
+	// The window already did its job tripping this ejection; reset it so
+	// the first 5xx after re-admission doesn't instantly re-trip
+	// consecutive5xx with a stale count.
+	if w != nil {
+		w.reset()
+	}
+
+	if b.OutlierMetrics.Ejected != nil {
+		b.OutlierMetrics.Ejected(name, reason)
+	}
+	b.propagateStatus(context.Background(), before, after)
+
+	duration := b.outlierCfg.BaseEjectionTime
+	for i := 1; i < ejections && duration < maxOutlierEjection; i++ {
+		duration *= 2
+	}
+	if duration <= 0 || duration > maxOutlierEjection {
+		duration = maxOutlierEjection
+	}
+
+	time.AfterFunc(duration, func() {
+		b.mutex.Lock()
+		delete(b.outlierActive, name)
+		nh := b.handlersByName[name]
+		var before, after bool
+		if nh != nil {
+			// Only actually resurrect the handler if no external health
+			// check independently took it down in the meantime.
+			before, after = b.transitionHealthy(nh, nh.externalHealthy)
+		}
+		b.mutex.Unlock()
+
+		if b.OutlierMetrics.Unejected != nil {
+			b.OutlierMetrics.Unejected(name)
+		}
+		b.propagateStatus(context.Background(), before, after)
+	})
+}
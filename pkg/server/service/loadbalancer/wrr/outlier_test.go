@@ -0,0 +1,164 @@
+package wrr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutlierEjectsOnConsecutive5xx(t *testing.T) {
+	b := New(nil, false, WithOutlierDetection(OutlierDetectionConfig{
+		Consecutive5xx:   2,
+		BaseEjectionTime: time.Hour,
+	}))
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+	// Only A should ever be picked, so both failing requests land on it
+	// and actually accumulate consecutive 5xxs instead of alternating.
+	b.SetStatus(context.Background(), "B", false)
+
+	var ejected, unejected []string
+	b.OutlierMetrics.Ejected = func(name, reason string) { ejected = append(ejected, name+":"+reason) }
+	b.OutlierMetrics.Unejected = func(name string) { unejected = append(unejected, name) }
+
+	failing := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "boom", http.StatusInternalServerError)
+	})
+	a := b.handlersByName["A"]
+	a.Handler = failing
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		b.ServeHTTP(rec, req)
+	}
+
+	require.False(t, a.healthy)
+	assert.Equal(t, []string{"A:consecutive 5xx"}, ejected)
+	assert.Empty(t, unejected)
+}
+
+func TestOutlierRespectsMaxEjectionPercent(t *testing.T) {
+	b := New(nil, false, WithOutlierDetection(OutlierDetectionConfig{
+		Consecutive5xx:     1,
+		BaseEjectionTime:   time.Hour,
+		MaxEjectionPercent: 50,
+	}))
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+
+	var skipped []string
+	b.OutlierMetrics.SkippedMaxEjection = func(name, reason string) { skipped = append(skipped, name) }
+
+	b.ejectOutlier("A", "consecutive 5xx")
+	require.False(t, b.handlersByName["A"].healthy)
+
+	// Ejecting B too would take out 100% of the pool, over the 50% cap.
+	b.ejectOutlier("B", "consecutive 5xx")
+	assert.True(t, b.handlersByName["B"].healthy)
+	assert.Equal(t, []string{"B"}, skipped)
+}
+
+func TestOutlierMaxEjectionPercentCountsOnlyHealthy(t *testing.T) {
+	b := New(nil, false, WithOutlierDetection(OutlierDetectionConfig{
+		Consecutive5xx:     1,
+		BaseEjectionTime:   time.Hour,
+		MaxEjectionPercent: 50,
+	}))
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+	addDummyHandler(b, "C", 1)
+	addDummyHandler(b, "D", 1)
+
+	// C and D are already down (e.g. via an external health check), so
+	// only A and B are healthy.
+	b.SetStatus(context.Background(), "C", false)
+	b.SetStatus(context.Background(), "D", false)
+
+	var skipped []string
+	b.OutlierMetrics.SkippedMaxEjection = func(name, reason string) { skipped = append(skipped, name) }
+
+	// 50% of the 2 healthy handlers is 1, so A may be ejected...
+	b.ejectOutlier("A", "consecutive 5xx")
+	require.False(t, b.handlersByName["A"].healthy)
+
+	// ...but ejecting B too would take out the entire remaining healthy
+	// pool. Counting the cap against the full handler count (including
+	// the already-down C and D) would have allowed it.
+	b.ejectOutlier("B", "consecutive 5xx")
+	assert.True(t, b.handlersByName["B"].healthy)
+	assert.Equal(t, []string{"B"}, skipped)
+}
+
+func TestOutlierUnejectsAfterBaseEjectionTime(t *testing.T) {
+	b := New(nil, false, WithOutlierDetection(OutlierDetectionConfig{
+		Consecutive5xx:   1,
+		BaseEjectionTime: 10 * time.Millisecond,
+	}))
+	addDummyHandler(b, "A", 1)
+
+	var unejected []string
+	b.OutlierMetrics.Unejected = func(name string) { unejected = append(unejected, name) }
+
+	b.ejectOutlier("A", "consecutive 5xx")
+	require.False(t, b.handlersByName["A"].healthy)
+
+	require.Eventually(t, func() bool {
+		return b.handlersByName["A"].healthy
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"A"}, unejected)
+}
+
+func TestOutlierUnejectDoesNotOverrideExternalHealthCheck(t *testing.T) {
+	b := New(nil, false, WithOutlierDetection(OutlierDetectionConfig{
+		Consecutive5xx:   1,
+		BaseEjectionTime: 10 * time.Millisecond,
+	}))
+	addDummyHandler(b, "A", 1)
+
+	var unejected []string
+	b.OutlierMetrics.Unejected = func(name string) { unejected = append(unejected, name) }
+
+	b.ejectOutlier("A", "consecutive 5xx")
+	require.False(t, b.handlersByName["A"].healthy)
+
+	// An external health check independently takes A down while it's
+	// still outlier-ejected.
+	b.SetStatus(context.Background(), "A", false)
+
+	// Once the outlier ejection timer fires, A should stay down: the
+	// external health check never said it recovered.
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, b.handlersByName["A"].healthy)
+	assert.Equal(t, []string{"A"}, unejected)
+
+	b.SetStatus(context.Background(), "A", true)
+	assert.True(t, b.handlersByName["A"].healthy)
+}
+
+func TestOutlierWindowResetsOnEjection(t *testing.T) {
+	b := New(nil, false, WithOutlierDetection(OutlierDetectionConfig{
+		Consecutive5xx:   2,
+		BaseEjectionTime: time.Hour,
+	}))
+	addDummyHandler(b, "A", 1)
+	nh := b.handlersByName["A"]
+
+	b.recordOutlierResult(nh, http.StatusInternalServerError)
+	b.recordOutlierResult(nh, http.StatusInternalServerError) // trips ejection at 2
+
+	w := b.outlierWindows["A"]
+	require.NotNil(t, w)
+	assert.Zero(t, w.consecutive5xx)
+
+	// A single 5xx right after ejection shouldn't immediately re-trip
+	// consecutive5xx, since the window was reset rather than carrying
+	// over its count from before ejection.
+	breach, _ := w.observe(b.outlierCfg, time.Now(), http.StatusInternalServerError)
+	assert.False(t, breach)
+}
@@ -0,0 +1,265 @@
+package wrr
+
+import (
+	"math/rand"
+	"time"
+)
+
+// SelectionStrategy controls how Balancer picks a handler for a request
+// that isn't pinned by a sticky cookie.
+type SelectionStrategy int
+
+const (
+	// StrategyEDF selects handlers using the Earliest Deadline First
+	// priority queue (the historical, default behavior).
+	StrategyEDF SelectionStrategy = iota
+	// StrategyP2CEWMA selects handlers using Power-of-Two-Choices: it
+	// samples two handlers at random, weighted by their effective
+	// (slow-start adjusted) weight, and picks the one with the lower
+	// EWMA-of-latency times pending-count score, divided by that weight
+	// (see p2cScore). Picking does not pop or push the heap, but each pick
+	// still takes the Balancer's exclusive mutex, as under StrategyEDF. It
+	// tends to produce better tail latency than EDF when backend latencies
+	// are heterogeneous.
+	StrategyP2CEWMA
+)
+
+// ewmaDecay is how much weight the most recent latency sample carries when
+// updating a handler's EWMA.
+const ewmaDecay = 0.3
+
+// selector is the unexported interface behind which handler-selection
+// strategies are implemented, so that new strategies (least-conn, random,
+// ...) can be added without touching Balancer's public surface.
+type selector interface {
+	acquire(preferredName string, cost uint64) (*namedHandler, error)
+}
+
+// acquirePreferred is the fast path shared by every selection strategy: if
+// the caller pinned a handler by name (e.g. via a sticky cookie) and it is
+// healthy, use it directly. A canary is never eligible here even if named
+// explicitly: it was never pushed onto enabledHandlers, so fixing it up
+// would corrupt the heap, and it must only ever receive its ramped
+// fractional share through pickCanary. Must be called with b.mutex held.
+func (b *Balancer) acquirePreferred(preferredName string, cost uint64) (*namedHandler, bool) {
+	if preferredName == "" {
+		return nil, false
+	}
+	nh := b.handlersByName[preferredName]
+	if nh == nil || !nh.healthy || nh.isCanary {
+		return nil, false
+	}
+	nh.pending += cost
+	b.enabledHandlers.fix(nh)
+	return nh, true
+}
+
+// edfSelector implements StrategyEDF on top of the Balancer's heap-ordered
+// priority queue.
+type edfSelector struct {
+	b *Balancer
+}
+
+func (s *edfSelector) acquire(preferredName string, cost uint64) (*namedHandler, error) {
+	b := s.b
+	if nh, ok := b.acquirePreferred(preferredName, cost); ok {
+		return nh, nil
+	}
+
+	b.reheapWarming()
+	for {
+		nh := b.enabledHandlers.pop()
+		if nh == nil {
+			return nil, errNoAvailableServer
+		}
+		if !nh.healthy {
+			continue
+		}
+		nh.pending += cost
+		b.enabledHandlers.push(nh)
+		return nh, nil
+	}
+}
+
+// p2cSelector implements StrategyP2CEWMA: two candidates are sampled from
+// an alias table (weighted by configured weight) and the one with the
+// lower ewma*pending score is picked.
+type p2cSelector struct {
+	b *Balancer
+}
+
+func (s *p2cSelector) acquire(preferredName string, cost uint64) (*namedHandler, error) {
+	b := s.b
+	if nh, ok := b.acquirePreferred(preferredName, cost); ok {
+		return nh, nil
+	}
+
+	if b.anyWarming() {
+		// The alias table's sampling weights and the score below both
+		// depend on effectiveWeight, which decays continuously while a
+		// handler is warming up; keep it current the same way
+		// reheapWarming does for the EDF heap.
+		b.rebuildAliasTable()
+	}
+	if b.aliasTable == nil || len(b.aliasTable.handlers) == 0 {
+		return nil, errNoAvailableServer
+	}
+
+	now := time.Now()
+	h1, h2 := b.aliasTable.sampleTwo()
+	nh := h1
+	if p2cScore(h2, now) < p2cScore(h1, now) {
+		nh = h2
+	}
+	nh.pending += cost
+	return nh, nil
+}
+
+// anyWarming reports whether any registered handler is still ramping up
+// under slow start. Must be called with b.mutex held.
+func (b *Balancer) anyWarming() bool {
+	now := time.Now()
+	for _, nh := range b.handlersByName {
+		if nh.warming(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// p2cScore scores nh for power-of-two-choices: lower is more eligible. It
+// divides by effectiveWeight so a handler still ramping up under slow start
+// looks proportionally busier than its ewma/pending alone would suggest. A
+// handler with no latency sample yet (ewma 0) scores 0 whatever its weight
+// and wins any comparison it is drawn into; under slow start, how often it
+// is drawn is limited by the alias table's effectiveWeight sampling.
+func p2cScore(nh *namedHandler, now time.Time) float64 {
+	return nh.ewma * float64(nh.pending+1) / nh.effectiveWeight(now)
+}
+
+// updateEWMA folds latency into nh's decaying EWMA of recent latency. Only
+// meaningful under StrategyP2CEWMA; acquiring the mutex keeps it safe to
+// call concurrently with selection and rebuilds.
+func (b *Balancer) updateEWMA(nh *namedHandler, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sample := float64(latency)
+	if nh.ewma == 0 {
+		nh.ewma = sample
+		return
+	}
+	nh.ewma = ewmaDecay*sample + (1-ewmaDecay)*nh.ewma
+}
+
+// rebuildAliasTable recomputes b.aliasTable from the currently healthy
+// handlers. Only needed under StrategyP2CEWMA; must be called with
+// b.mutex held.
+func (b *Balancer) rebuildAliasTable() {
+	if b.strategy != StrategyP2CEWMA {
+		return
+	}
+	healthy := make([]*namedHandler, 0, len(b.handlersByName))
+	for _, nh := range b.handlersByName {
+		// Canaries are excluded: they're only ever picked via pickCanary's
+		// fractional ramp, and including them here would let them also
+		// receive normal WRR traffic on top of that fraction.
+		if nh.healthy && !nh.isCanary {
+			healthy = append(healthy, nh)
+		}
+	}
+	b.aliasTable = newAliasTable(healthy, time.Now())
+}
+
+// aliasTable is Walker's alias method: O(1) sampling of a discrete
+// distribution after an O(n) build.
+type aliasTable struct {
+	handlers []*namedHandler
+	prob     []float64
+	alias    []int
+}
+
+func newAliasTable(handlers []*namedHandler, now time.Time) *aliasTable {
+	n := len(handlers)
+	t := &aliasTable{handlers: handlers, prob: make([]float64, n), alias: make([]int, n)}
+	if n == 0 {
+		return t
+	}
+
+	// Sample by effectiveWeight rather than weight, so a handler still
+	// ramping up under slow start is drawn less often, the same way it
+	// would be picked less often from the EDF heap.
+	var totalWeight float64
+	for _, h := range handlers {
+		totalWeight += h.effectiveWeight(now)
+	}
+	if totalWeight <= 0 {
+		totalWeight = float64(n)
+	}
+
+	scaled := make([]float64, n)
+	for i, h := range handlers {
+		scaled[i] = h.effectiveWeight(now) / totalWeight * float64(n)
+	}
+
+	var small, large []int
+	for i, p := range scaled {
+		if p < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		s := small[len(small)-1]
+		small = small[:len(small)-1]
+		l := large[len(large)-1]
+		large = large[:len(large)-1]
+
+		t.prob[s] = scaled[s]
+		t.alias[s] = l
+
+		scaled[l] = scaled[l] + scaled[s] - 1
+		if scaled[l] < 1 {
+			small = append(small, l)
+		} else {
+			large = append(large, l)
+		}
+	}
+	for _, l := range large {
+		t.prob[l] = 1
+	}
+	for _, s := range small {
+		t.prob[s] = 1
+	}
+
+	return t
+}
+
+func (t *aliasTable) sample() *namedHandler {
+	n := len(t.handlers)
+	if n == 0 {
+		return nil
+	}
+	i := rand.Intn(n)
+	if rand.Float64() < t.prob[i] {
+		return t.handlers[i]
+	}
+	return t.handlers[t.alias[i]]
+}
+
+// sampleTwo picks two candidates for power-of-two-choices. If the table
+// only has one entry, both results are that same handler.
+func (t *aliasTable) sampleTwo() (*namedHandler, *namedHandler) {
+	h1 := t.sample()
+	if h1 == nil || len(t.handlers) == 1 {
+		return h1, h1
+	}
+	for i := 0; i < 10; i++ {
+		h2 := t.sample()
+		if h2.name != h1.name {
+			return h1, h2
+		}
+	}
+	return h1, h1
+}
@@ -0,0 +1,51 @@
+package wrr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalancerP2CEWMA(t *testing.T) {
+	b := New(nil, false, WithSelectionStrategy(StrategyP2CEWMA))
+	addDummyHandler(b, "fast", 1)
+	addDummyHandler(b, "slow", 1)
+
+	b.updateEWMA(b.handlersByName["fast"], time.Millisecond)
+	b.updateEWMA(b.handlersByName["slow"], 100*time.Millisecond)
+
+	// The alias table only has two entries, so with enough draws both
+	// should be sampled, but the lower-latency handler should win the
+	// comparison far more often.
+	picks := map[string]int{}
+	for i := 0; i < 200; i++ {
+		nh, err := b.acquireHandler(handlerAny, 1)
+		require.NoError(t, err)
+		picks[nh.name]++
+		b.releaseHandler(nh, 1)
+	}
+	assert.Greater(t, picks["fast"], picks["slow"])
+}
+
+func TestAliasTableSampleTwoDistinct(t *testing.T) {
+	b := New(nil, false, WithSelectionStrategy(StrategyP2CEWMA))
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+	addDummyHandler(b, "C", 1)
+
+	h1, h2 := b.aliasTable.sampleTwo()
+	require.NotNil(t, h1)
+	require.NotNil(t, h2)
+	assert.NotEqual(t, h1.name, h2.name)
+}
+
+func TestAliasTableSingleHandler(t *testing.T) {
+	b := New(nil, false, WithSelectionStrategy(StrategyP2CEWMA))
+	addDummyHandler(b, "only", 1)
+
+	h1, h2 := b.aliasTable.sampleTwo()
+	assert.Equal(t, "only", h1.name)
+	assert.Equal(t, "only", h2.name)
+}
@@ -0,0 +1,69 @@
+package wrr
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalancerSlowStart(t *testing.T) {
+	b := New(nil, false, WithSlowStart(time.Hour))
+	addDummyHandler(b, "warm", 1)
+
+	ss := time.Hour
+	weight := 1
+	b.Add("cold", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), &weight, WithHandlerSlowStart(ss))
+
+	cold := b.handlersByName["cold"]
+	cold.readyAt = time.Now().Add(-ss / 2) // halfway through its ramp
+
+	assert.InDelta(t, 0.5, cold.effectiveWeight(time.Now()), 0.01)
+	assert.True(t, cold.warming(time.Now()))
+
+	cold.readyAt = time.Now().Add(-2 * ss)
+	assert.Equal(t, 1.0, cold.effectiveWeight(time.Now()))
+	assert.False(t, cold.warming(time.Now()))
+}
+
+func TestBalancerSlowStartResetsOnRecovery(t *testing.T) {
+	b := New(nil, false, WithSlowStart(time.Hour))
+	addDummyHandler(b, "A", 1)
+
+	b.SetStatus(context.Background(), "A", false)
+	b.SetStatus(context.Background(), "A", true)
+
+	nh := b.handlersByName["A"]
+	assert.True(t, nh.warming(time.Now()))
+}
+
+func TestP2CRespectsSlowStart(t *testing.T) {
+	b := New(nil, false, WithSlowStart(time.Hour), WithSelectionStrategy(StrategyP2CEWMA))
+	addDummyHandler(b, "warm", 1)
+	b.updateEWMA(b.handlersByName["warm"], time.Millisecond)
+
+	ss := time.Hour
+	weight := 1
+	b.Add("cold", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}), &weight, WithHandlerSlowStart(ss))
+	// The cold handler hasn't served anything yet, so its score is 0 and
+	// it wins every comparison it is drawn into. Slow start keeps it from
+	// being flooded by drawing it into far fewer comparisons: the alias
+	// table samples it by its still-tiny effective weight.
+	cold := b.handlersByName["cold"]
+	cold.readyAt = time.Now().Add(-ss / 100) // just started ramping
+
+	picks := map[string]int{}
+	for i := 0; i < 50; i++ {
+		nh, err := b.acquireHandler(handlerAny, 1)
+		assert.NoError(t, err)
+		picks[nh.name]++
+		b.releaseHandler(nh, 1)
+	}
+	assert.Greater(t, picks["warm"], picks["cold"])
+}
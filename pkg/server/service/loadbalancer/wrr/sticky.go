@@ -0,0 +1,150 @@
+package wrr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FallbackPolicy controls what Balancer does for a sticky request whose
+// pinned backend can't serve it right now.
+type FallbackPolicy int
+
+const (
+	// FallbackRedistribute sends the request through normal load-balanced
+	// selection, same as if it had never been pinned. This is the
+	// historical behavior.
+	FallbackRedistribute FallbackPolicy = iota
+	// FallbackError returns a 503 whenever the pinned backend isn't
+	// healthy, rather than silently redistributing the request.
+	FallbackError
+	// FallbackDrainOnly returns a 503 only once the pinned backend has
+	// been removed entirely. While it still exists but is unhealthy
+	// (e.g. draining during a deploy), the request is held briefly in
+	// case it recovers before falling back to redistribution.
+	FallbackDrainOnly
+)
+
+const (
+	stickyDrainGrace        = 50 * time.Millisecond
+	stickyDrainPollInterval = 5 * time.Millisecond
+)
+
+var errStickyBackendUnavailable = errors.New("sticky backend unavailable")
+
+// ConfigureSticky sets the HMAC secret used to sign sticky-session cookies,
+// how long a cookie stays valid, and what to do when the pinned backend
+// can't serve the request. It is a no-op if no sticky cookie was configured
+// via New. A nil or empty secret disables signing (cookies carry the plain
+// backend name, as before).
+func (b *Balancer) ConfigureSticky(secret []byte, maxAge time.Duration, fallback FallbackPolicy) {
+	if b.stickyCookie == nil {
+		return
+	}
+	b.stickyCookie.secret = secret
+	b.stickyCookie.maxAge = maxAge
+	b.stickyCookie.fallback = fallback
+}
+
+// encode produces the cookie value that pins the client to handlerName: the
+// plain name if no secret is configured, or "name|expiresUnix|hmac"
+// otherwise.
+func (s *stickyCookie) encode(handlerName string) string {
+	if len(s.secret) == 0 {
+		return handlerName
+	}
+
+	var expires int64
+	if s.maxAge > 0 {
+		expires = time.Now().Add(s.maxAge).Unix()
+	}
+	payload := handlerName + "|" + strconv.FormatInt(expires, 10)
+	return payload + "|" + s.sign(payload)
+}
+
+// decode validates value against the configured secret and expiry, and
+// returns the pinned handler name. valid is false if value is malformed, its
+// signature doesn't match, or it has expired. If no secret is configured,
+// value is returned as-is with valid true.
+func (s *stickyCookie) decode(value string) (handlerName string, valid bool) {
+	if len(s.secret) == 0 {
+		return value, true
+	}
+
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload := parts[0] + "|" + parts[1]
+	if !hmac.Equal([]byte(s.sign(payload)), []byte(parts[2])) {
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if expires != 0 && time.Now().Unix() > expires {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+func (s *stickyCookie) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// acquireSticky resolves a pinned, sticky request according to the
+// configured FallbackPolicy, rather than silently falling back to plain
+// redistribution the way acquireHandler's preferred-name fast path used to.
+func (b *Balancer) acquireSticky(preferredName string, cost uint64) (*namedHandler, error) {
+	b.mutex.RLock()
+	pinned := b.handlersByName[preferredName]
+	policy := b.stickyCookie.fallback
+	b.mutex.RUnlock()
+
+	if pinned != nil && pinned.healthy {
+		return b.acquireHandler(preferredName, cost)
+	}
+
+	switch policy {
+	case FallbackError:
+		return nil, errStickyBackendUnavailable
+
+	case FallbackDrainOnly:
+		if pinned == nil {
+			return nil, errStickyBackendUnavailable
+		}
+		if b.waitForRecovery(pinned, stickyDrainGrace) {
+			return b.acquireHandler(preferredName, cost)
+		}
+		return b.acquireHandler("", cost)
+
+	default: // FallbackRedistribute
+		return b.acquireHandler("", cost)
+	}
+}
+
+// waitForRecovery polls nh.healthy for up to grace, returning true as soon
+// as it becomes healthy again.
+func (b *Balancer) waitForRecovery(nh *namedHandler, grace time.Duration) bool {
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		time.Sleep(stickyDrainPollInterval)
+		b.mutex.RLock()
+		healthy := nh.healthy
+		b.mutex.RUnlock()
+		if healthy {
+			return true
+		}
+	}
+	return false
+}
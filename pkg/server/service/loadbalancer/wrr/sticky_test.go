@@ -0,0 +1,108 @@
+package wrr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStickyBalancer(fallback FallbackPolicy) *Balancer {
+	b := New(nil, false)
+	b.stickyCookie = &stickyCookie{name: "test-sticky"}
+	b.ConfigureSticky([]byte("secret"), time.Minute, fallback)
+	return b
+}
+
+func doRequest(b *Balancer, cookieValue string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookieValue != "" {
+		req.AddCookie(&http.Cookie{Name: "test-sticky", Value: cookieValue})
+	}
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStickyCookieSignedRoundTrip(t *testing.T) {
+	b := newStickyBalancer(FallbackRedistribute)
+	addDummyHandler(b, "A", 1)
+
+	rec := doRequest(b, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "A", rec.Header().Get("server"))
+
+	name, valid := b.stickyCookie.decode(cookies[0].Value)
+	assert.True(t, valid)
+	assert.Equal(t, "A", name)
+}
+
+func TestStickyCookieTamperedRejected(t *testing.T) {
+	b := newStickyBalancer(FallbackRedistribute)
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+
+	signed := b.stickyCookie.encode("A")
+	last := "0"
+	if signed[len(signed)-1] == '0' {
+		last = "1"
+	}
+	tampered := signed[:len(signed)-1] + last
+
+	_, valid := b.stickyCookie.decode(tampered)
+	assert.False(t, valid)
+
+	// A tampered cookie is treated as absent, so the request is load
+	// balanced normally instead of trusting the forged name.
+	rec := doRequest(b, tampered)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestStickyFallbackRedistribute(t *testing.T) {
+	b := newStickyBalancer(FallbackRedistribute)
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+	b.SetStatus(context.Background(), "A", false)
+
+	rec := doRequest(b, b.stickyCookie.encode("A"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "B", rec.Header().Get("server"))
+}
+
+func TestStickyFallbackError(t *testing.T) {
+	b := newStickyBalancer(FallbackError)
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+	b.SetStatus(context.Background(), "A", false)
+
+	rec := doRequest(b, b.stickyCookie.encode("A"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestStickyFallbackDrainOnlyRemoved(t *testing.T) {
+	b := newStickyBalancer(FallbackDrainOnly)
+	addDummyHandler(b, "A", 1)
+
+	rec := doRequest(b, b.stickyCookie.encode("ghost"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestStickyFallbackDrainOnlyStillPresent(t *testing.T) {
+	b := newStickyBalancer(FallbackDrainOnly)
+	addDummyHandler(b, "A", 1)
+	addDummyHandler(b, "B", 1)
+	b.SetStatus(context.Background(), "A", false)
+
+	rec := doRequest(b, b.stickyCookie.encode("A"))
+	// A is still registered, just unhealthy: after the brief grace period
+	// it should redistribute to B rather than erroring outright.
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "B", rec.Header().Get("server"))
+}
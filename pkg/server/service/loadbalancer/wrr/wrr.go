@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
 	"github.com/traefik/traefik/v2/pkg/config/runtime"
@@ -19,12 +20,78 @@ type namedHandler struct {
 	pending  uint64
 	healthy  bool
 	queueIdx int
+
+	// externalHealthy is the last status reported through SetStatus, i.e.
+	// by an external health check. It is combined with outlier-ejection
+	// state (see outlier.go) to produce healthy, so the two down-reasons
+	// don't stomp on each other: an outlier-induced ejection clearing
+	// shouldn't resurrect a handler an external health check took down,
+	// and vice versa.
+	externalHealthy bool
+
+	// isCanary marks a handler registered through AddCanary. Canaries are
+	// served only through pickCanary's fractional traffic split, so they
+	// must stay out of enabledHandlers, the P2C alias table, and the
+	// preferred/sticky-name fast path, all of which are reserved for
+	// normal WRR traffic. Cleared by PromoteCanary once the handler
+	// graduates to a normal one.
+	isCanary bool
+
+	// slowStart is how long this handler ramps its effective weight up from
+	// 1% of weight to weight for, starting at readyAt. A zero value
+	// disables slow start.
+	slowStart time.Duration
+	// readyAt is when the handler last became eligible to serve traffic,
+	// either because it was added or because it just recovered from
+	// unhealthy. It anchors the slow-start ramp.
+	readyAt time.Time
+
+	// ewma is a decaying exponentially-weighted moving average of recent
+	// request latency, in nanoseconds. Only maintained under
+	// StrategyP2CEWMA.
+	ewma float64
+}
+
+// effectiveWeight returns nh's weight, scaled down if it is still ramping
+// up under slow start. The result is never 0, so it always stays usable as
+// a divisor.
+func (nh *namedHandler) effectiveWeight(now time.Time) float64 {
+	if nh.slowStart <= 0 {
+		return nh.weight
+	}
+	elapsed := now.Sub(nh.readyAt)
+	if elapsed >= nh.slowStart {
+		return nh.weight
+	}
+
+	ratio := float64(elapsed) / float64(nh.slowStart)
+	const minRatio = 0.01
+	if ratio < minRatio {
+		ratio = minRatio
+	}
+	return nh.weight * ratio
+}
+
+// warming reports whether nh is still ramping up under slow start.
+func (nh *namedHandler) warming(now time.Time) bool {
+	return nh.slowStart > 0 && now.Sub(nh.readyAt) < nh.slowStart
 }
 
 type stickyCookie struct {
 	name     string
 	secure   bool
 	httpOnly bool
+
+	// secret is the HMAC key used to sign cookie values so clients can't
+	// pin themselves to an arbitrary backend name. Signing is disabled
+	// when empty. See ConfigureSticky.
+	secret []byte
+	// maxAge is how long a sticky cookie stays valid for. Zero means no
+	// expiry.
+	maxAge time.Duration
+	// fallback controls what happens when the pinned backend can't serve
+	// the request.
+	fallback FallbackPolicy
 }
 
 // Balancer is a WeightedRoundRobin load balancer based on Earliest Deadline First (EDF).
@@ -39,17 +106,103 @@ type Balancer struct {
 	// parent(s)), whenever the Balancer status changes.
 	updaters []func(bool)
 
+	// CostEstimator estimates the cost of handling a request, in the same
+	// unit as namedHandler.pending. It is consulted before a handler is
+	// picked, so that handlers serving expensive requests don't also get
+	// picked for extra cheap ones just because their request count happens
+	// to be low. Defaults to NewContentLengthCostEstimator(0).
+	CostEstimator CostEstimator
+
+	// slowStart is the default ramp-up duration applied to handlers added
+	// without an explicit per-handler override. See Add.
+	slowStart time.Duration
+
+	// strategy selects which selector implementation acquireHandler
+	// delegates to.
+	strategy SelectionStrategy
+	selector selector
+	// aliasTable is the weighted-random sampler used by StrategyP2CEWMA,
+	// rebuilt whenever the set of healthy handlers changes.
+	aliasTable *aliasTable
+
 	mutex           sync.RWMutex
 	enabledHandlers priorityQueue
 	handlersByName  map[string]*namedHandler
 	healthyCount    int
+
+	// canaries holds the canary handlers registered via AddCanary, keyed by
+	// name. They are kept out of enabledHandlers so their traffic share is
+	// governed by their ramp fraction rather than by pending/weight.
+	canaries map[string]*canaryState
+	// canaryUpdaters is the list of hooks run whenever a canary is
+	// auto-reverted.
+	canaryUpdaters []func(name, reason string)
+
+	// outlierCfg configures passive outlier ejection. See
+	// OutlierDetectionConfig.
+	outlierCfg OutlierDetectionConfig
+	// OutlierMetrics are optional hooks reporting outlier-detection
+	// activity.
+	OutlierMetrics OutlierMetricsHooks
+	// outlierWindows holds the rolling error window for each handler,
+	// keyed by name.
+	outlierWindows map[string]*outlierWindow
+	// outlierActive is the set of handlers currently ejected by outlier
+	// detection, used to enforce MaxEjectionPercent.
+	outlierActive map[string]bool
+	// outlierEjections counts how many times each handler has been
+	// ejected, so its ejection time can keep doubling.
+	outlierEjections map[string]int
+}
+
+// Option configures optional Balancer behavior at construction time. See
+// WithSlowStart, WithSelectionStrategy, and WithOutlierDetection.
+type Option func(*Balancer)
+
+// WithSlowStart sets the default duration over which a newly added (or
+// newly recovered) handler's effective weight ramps up from 1% of its
+// configured weight to all of it; see Add.
+func WithSlowStart(slowStart time.Duration) Option {
+	return func(b *Balancer) {
+		b.slowStart = slowStart
+	}
+}
+
+// WithSelectionStrategy selects how handlers are picked for requests that
+// aren't pinned by a sticky cookie. The default is StrategyEDF.
+func WithSelectionStrategy(strategy SelectionStrategy) Option {
+	return func(b *Balancer) {
+		b.strategy = strategy
+	}
+}
+
+// WithOutlierDetection enables passive outlier ejection using cfg. Omitting
+// this option disables it, relying solely on external health checks as
+// before.
+func WithOutlierDetection(cfg OutlierDetectionConfig) Option {
+	return func(b *Balancer) {
+		b.outlierCfg = cfg
+	}
 }
 
 // New creates a new load balancer.
-func New(sticky *dynamic.Sticky, wantHealthCheck bool) *Balancer {
+func New(sticky *dynamic.Sticky, wantHealthCheck bool, opts ...Option) *Balancer {
 	balancer := &Balancer{
 		handlersByName:   make(map[string]*namedHandler),
 		wantsHealthCheck: wantHealthCheck,
+		CostEstimator:    NewContentLengthCostEstimator(0),
+		strategy:         StrategyEDF,
+		outlierWindows:   make(map[string]*outlierWindow),
+		outlierActive:    make(map[string]bool),
+		outlierEjections: make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(balancer)
+	}
+	if balancer.strategy == StrategyP2CEWMA {
+		balancer.selector = &p2cSelector{b: balancer}
+	} else {
+		balancer.selector = &edfSelector{b: balancer}
 	}
 	if sticky != nil && sticky.Cookie != nil {
 		balancer.stickyCookie = &stickyCookie{
@@ -62,7 +215,9 @@ func New(sticky *dynamic.Sticky, wantHealthCheck bool) *Balancer {
 }
 
 // SetStatus sets on the balancer that its given child is now of the given
-// status.
+// status, as reported by an external health check. A handler also currently
+// ejected by outlier detection (see outlier.go) stays down until both
+// sources agree it's healthy again.
 func (b *Balancer) SetStatus(ctx context.Context, childName string, healthy bool) {
 	log.FromContext(ctx).Debugf("Setting status of %s to %v", childName, statusAsStr(healthy))
 
@@ -72,31 +227,53 @@ func (b *Balancer) SetStatus(ctx context.Context, childName string, healthy bool
 		b.mutex.Unlock()
 		return
 	}
+	nh.externalHealthy = healthy
+	healthyBefore, healthyAfter := b.transitionHealthy(nh, healthy && !b.outlierActive[childName])
+	b.mutex.Unlock()
 
-	healthyBefore := b.healthyCount > 0
-	if nh.healthy != healthy {
-		nh.healthy = healthy
-		if healthy {
+	b.propagateStatus(ctx, healthyBefore, healthyAfter)
+}
+
+// transitionHealthy updates nh's healthy flag, along with the heap and
+// healthyCount bookkeeping that go with it, if combined differs from its
+// current value. It returns whether the balancer as a whole was up before
+// and after the change, for propagateStatus. Must be called with b.mutex
+// held.
+func (b *Balancer) transitionHealthy(nh *namedHandler, combined bool) (before, after bool) {
+	before = b.healthyCount > 0
+	if nh.isCanary {
+		// Canaries are kept out of enabledHandlers and healthyCount; see
+		// isCanary.
+		nh.healthy = combined
+		return before, before
+	}
+	if nh.healthy != combined {
+		nh.healthy = combined
+		if combined {
+			// Restart the slow-start ramp: a handler that just recovered
+			// shouldn't be flooded just because its pending count is 0.
+			nh.readyAt = time.Now()
 			b.healthyCount++
 			b.enabledHandlers.push(nh)
 		} else {
 			b.healthyCount--
 		}
+		b.rebuildAliasTable()
 	}
-	healthyAfter := b.healthyCount > 0
-	b.mutex.Unlock()
+	after = b.healthyCount > 0
+	return before, after
+}
 
-	// No Status Change
-	if healthyBefore == healthyAfter {
-		// We're still with the same status, no need to propagate
-		log.FromContext(ctx).Debugf("Still %s, no need to propagate", statusAsStr(healthyBefore))
+// propagateStatus runs b.updaters if the balancer's overall up/down status
+// changed between before and after.
+func (b *Balancer) propagateStatus(ctx context.Context, before, after bool) {
+	if before == after {
+		log.FromContext(ctx).Debugf("Still %s, no need to propagate", statusAsStr(before))
 		return
 	}
-
-	// Status Change
-	log.FromContext(ctx).Debugf("Propagating new %s status", statusAsStr(healthyAfter))
+	log.FromContext(ctx).Debugf("Propagating new %s status", statusAsStr(after))
 	for _, fn := range b.updaters {
-		fn(healthyAfter)
+		fn(after)
 	}
 }
 
@@ -120,50 +297,46 @@ func (b *Balancer) RegisterStatusUpdater(fn func(up bool)) error {
 
 var errNoAvailableServer = errors.New("no available server")
 
-func (b *Balancer) acquireHandler(preferredName string) (*namedHandler, error) {
+func (b *Balancer) acquireHandler(preferredName string, cost uint64) (*namedHandler, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	var nh *namedHandler
-	// Check the preferred handler fist if provided.
-	if preferredName != "" {
-		nh = b.handlersByName[preferredName]
-		if nh != nil && nh.healthy {
-			nh.pending++
-			b.enabledHandlers.fix(nh)
-			return nh, nil
-		}
-	}
-	// Pick the handler with the least number of pending requests.
-	for {
-		nh = b.enabledHandlers.pop()
-		if nh == nil {
-			return nil, errNoAvailableServer
-		}
-		// If the handler is marked as unhealthy, then continue with the next
-		// best option. It will be put back into the priority queue once its
-		// status changes to healthy.
-		if !nh.healthy {
-			continue
-		}
-		// Otherwise increment the number of pending requests, put it back into
-		// the priority queue, and return it as a selected for the request.
-		nh.pending++
-		b.enabledHandlers.push(nh)
-		log.WithoutContext().Debugf("Service selected by WRR: %s", nh.name)
-		return nh, nil
+	nh, err := b.selector.acquire(preferredName, cost)
+	if err != nil {
+		return nil, err
 	}
+	log.WithoutContext().Debugf("Service selected by WRR: %s", nh.name)
+	return nh, nil
 }
 
-func (b *Balancer) releaseHandler(nh *namedHandler) {
+func (b *Balancer) releaseHandler(nh *namedHandler, cost uint64) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	nh.pending--
+	if cost > nh.pending {
+		nh.pending = 0
+	} else {
+		nh.pending -= cost
+	}
 	if nh.healthy {
 		b.enabledHandlers.fix(nh)
 	}
 }
 
+// Release hands back cost, the same value passed to acquireHandler (via
+// estimateCost) when the handler was picked for a now-completed request, so
+// it no longer counts against nh.pending, and re-weighs nh in the priority
+// queue accordingly. It is exported so callers driving nh.ServeHTTP
+// themselves (rather than through Balancer.ServeHTTP) can still report
+// completion.
+func (b *Balancer) Release(nh *namedHandler, cost uint64) {
+	b.releaseHandler(nh, cost)
+}
+
 func (b *Balancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if cs := b.pickCanary(); cs != nil {
+		b.serveCanary(w, req, cs)
+		return
+	}
+
 	var preferredName string
 	if b.stickyCookie != nil {
 		cookie, err := req.Cookie(b.stickyCookie.name)
@@ -171,14 +344,25 @@ func (b *Balancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			log.WithoutContext().Warnf("Error while reading cookie: %v", err)
 		}
 		if err == nil && cookie != nil {
-			preferredName = cookie.Value
+			if name, valid := b.stickyCookie.decode(cookie.Value); valid {
+				preferredName = name
+			}
 		}
 	}
-	nh, err := b.acquireHandler(preferredName)
+
+	cost := b.estimateCost(req)
+	var nh *namedHandler
+	var err error
+	if preferredName != "" {
+		nh, err = b.acquireSticky(preferredName, cost)
+	} else {
+		nh, err = b.acquireHandler(preferredName, cost)
+	}
 	if err != nil {
-		if errors.Is(err, errNoAvailableServer) {
-			http.Error(w, errNoAvailableServer.Error(), http.StatusServiceUnavailable)
-		} else {
+		switch {
+		case errors.Is(err, errNoAvailableServer), errors.Is(err, errStickyBackendUnavailable):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
@@ -189,21 +373,56 @@ func (b *Balancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if b.stickyCookie != nil {
 		cookie := &http.Cookie{
 			Name:     b.stickyCookie.name,
-			Value:    nh.name,
+			Value:    b.stickyCookie.encode(nh.name),
 			Path:     "/",
 			HttpOnly: b.stickyCookie.httpOnly,
 			Secure:   b.stickyCookie.secure,
 		}
+		if b.stickyCookie.maxAge > 0 {
+			cookie.MaxAge = int(b.stickyCookie.maxAge.Seconds())
+		}
 		http.SetCookie(w, cookie)
 	}
 
-	nh.ServeHTTP(w, req)
-	b.releaseHandler(nh)
+	rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	start := time.Now()
+	nh.ServeHTTP(rec, req)
+	if b.strategy == StrategyP2CEWMA {
+		b.updateEWMA(nh, time.Since(start))
+	}
+	b.recordOutlierResult(nh, rec.statusCode)
+	b.Release(nh, cost)
+}
+
+// estimateCost returns the expected cost of handling req, using
+// b.CostEstimator if set, falling back to a uniform cost of 1 per request
+// (equivalent to the plain request-count based weighting).
+func (b *Balancer) estimateCost(req *http.Request) uint64 {
+	if b.CostEstimator == nil {
+		return 1
+	}
+	cost := b.CostEstimator(req)
+	if cost == 0 {
+		return 1
+	}
+	return cost
+}
+
+// AddOption configures an individual handler at the time it's added to the
+// Balancer. See WithHandlerSlowStart.
+type AddOption func(*namedHandler)
+
+// WithHandlerSlowStart overrides the Balancer's default slow-start duration
+// for this handler only.
+func WithHandlerSlowStart(slowStart time.Duration) AddOption {
+	return func(nh *namedHandler) {
+		nh.slowStart = slowStart
+	}
 }
 
 // Add adds a handler.
 // A handler with a non-positive weight is ignored.
-func (b *Balancer) Add(name string, handler http.Handler, weight *int) {
+func (b *Balancer) Add(name string, handler http.Handler, weight *int, opts ...AddOption) {
 	w := 1
 	if weight != nil {
 		w = *weight
@@ -214,19 +433,41 @@ func (b *Balancer) Add(name string, handler http.Handler, weight *int) {
 	}
 
 	nh := &namedHandler{
-		Handler: handler,
-		name:    name,
-		weight:  float64(w),
-		pending: 1,
-		healthy: true,
+		Handler:         handler,
+		name:            name,
+		weight:          float64(w),
+		pending:         1,
+		healthy:         true,
+		externalHealthy: true,
+		slowStart:       b.slowStart,
+		readyAt:         time.Now(),
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(nh)
+		}
 	}
 	b.mutex.Lock()
 	b.enabledHandlers.push(nh)
 	b.handlersByName[nh.name] = nh
 	b.healthyCount++
+	b.rebuildAliasTable()
 	b.mutex.Unlock()
 }
 
+// reheapWarming re-establishes heap order for handlers that are still
+// ramping up under slow start, since their effective weight changes with
+// time even without a push/fix triggered by traffic. Must be called with
+// b.mutex held.
+func (b *Balancer) reheapWarming() {
+	now := time.Now()
+	for _, nh := range b.enabledHandlers.heap {
+		if nh.warming(now) {
+			b.enabledHandlers.fix(nh)
+		}
+	}
+}
+
 type priorityQueue struct {
 	heap []*namedHandler
 }
@@ -251,8 +492,9 @@ func (pq *priorityQueue) Len() int { return len(pq.heap) }
 
 // Less implements heap.Interface/sort.Interface.
 func (pq *priorityQueue) Less(i, j int) bool {
+	now := time.Now()
 	nhi, nhj := pq.heap[i], pq.heap[j]
-	return float64(nhi.pending)/nhi.weight < float64(nhj.pending)/nhj.weight
+	return float64(nhi.pending)/nhi.effectiveWeight(now) < float64(nhj.pending)/nhj.effectiveWeight(now)
 }
 
 // Swap implements heap.Interface/sort.Interface.
@@ -55,12 +55,12 @@ func TestBalancerUpAndDown(t *testing.T) {
 	b.SetStatus(context.Background(), "B", false)
 	assertAcquire(t, b, handlerAny, "A", map[string]int{"A": 5, "B": 2})
 	b.SetStatus(context.Background(), "A", false)
-	_, err := b.acquireHandler(handlerAny)
+	_, err := b.acquireHandler(handlerAny, 1)
 	assert.Equal(t, errNoAvailableServer, err)
 	assertRelease(t, b, "B", map[string]int{"A": 5, "B": 1})
 	assertRelease(t, b, "A", map[string]int{"A": 4, "B": 1})
 	assertRelease(t, b, "A", map[string]int{"A": 3, "B": 1})
-	_, err = b.acquireHandler(handlerAny)
+	_, err = b.acquireHandler(handlerAny, 1)
 	assert.Equal(t, errNoAvailableServer, err)
 	b.SetStatus(context.Background(), "A", true)
 	assertAcquire(t, b, handlerAny, "A", map[string]int{"A": 4, "B": 1})
@@ -151,22 +151,22 @@ func TestBalancerMany(t *testing.T) {
 		addDummyHandler(b, fmt.Sprintf("%c", handlerName), 1)
 	}
 	for i := 0; i < 100; i++ {
-		_, err := b.acquireHandler(handlerAny)
+		_, err := b.acquireHandler(handlerAny, 1)
 		require.NoError(t, err)
 	}
 	assert.Equal(t, map[string]int{"A": 13, "B": 13, "C": 12, "D": 13, "E": 12, "F": 12, "G": 12, "H": 13}, pendingCounts(b))
 	for i := 0; i < 10; i++ {
-		_, err := b.acquireHandler("D")
+		_, err := b.acquireHandler("D", 1)
 		require.NoError(t, err)
 	}
 	assert.Equal(t, map[string]int{"A": 13, "B": 13, "C": 12, "D": 23, "E": 12, "F": 12, "G": 12, "H": 13}, pendingCounts(b))
 	for i := 0; i < 74; i++ {
-		_, err := b.acquireHandler(handlerAny)
+		_, err := b.acquireHandler(handlerAny, 1)
 		require.NoError(t, err)
 	}
 	assert.Equal(t, map[string]int{"A": 23, "B": 23, "C": 23, "D": 23, "E": 23, "F": 23, "G": 23, "H": 23}, pendingCounts(b))
 	for i := 0; i < 8; i++ {
-		_, err := b.acquireHandler(handlerAny)
+		_, err := b.acquireHandler(handlerAny, 1)
 		require.NoError(t, err)
 	}
 	assert.Equal(t, map[string]int{"A": 24, "B": 24, "C": 24, "D": 24, "E": 24, "F": 24, "G": 24, "H": 24}, pendingCounts(b))
@@ -191,7 +191,7 @@ func pendingCounts(b *Balancer) map[string]int {
 }
 
 func assertAcquire(t *testing.T, b *Balancer, preferredName, acquiredName string, want map[string]int) {
-	nh, err := b.acquireHandler(preferredName)
+	nh, err := b.acquireHandler(preferredName, 1)
 	require.NoError(t, err)
 	assert.Equal(t, acquiredName, nh.name)
 	assert.Equal(t, want, pendingCounts(b))
@@ -201,6 +201,6 @@ func assertRelease(t *testing.T, b *Balancer, acquiredName string, want map[stri
 	b.mutex.Lock()
 	nh := b.handlersByName[acquiredName]
 	b.mutex.Unlock()
-	b.releaseHandler(nh)
+	b.releaseHandler(nh, 1)
 	assert.Equal(t, want, pendingCounts(b))
 }